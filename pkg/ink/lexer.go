@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"os"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -31,6 +33,11 @@ const (
 	ListLiteral
 	FunctionLiteral
 
+	// Comment is only ever produced when a Scanner is run with the
+	// ScanComments mode bit set; otherwise comments are discarded
+	// during scanning, as before.
+	Comment
+
 	TrueLiteral
 	FalseLiteral
 
@@ -69,13 +76,24 @@ const (
 	RightBracket
 	LeftBrace
 	RightBrace
+
+	// EOF is returned by Scanner.Scan once the source is exhausted.
+	EOF
 )
 
 type position struct {
+	filename  string
 	line, col int
+	// offset is the byte offset of this position from the start of
+	// the file, for embedders that need to build source maps or slice
+	// the original source (e.g. an LSP integration).
+	offset int
 }
 
 func (p position) String() string {
+	if p.filename != "" {
+		return fmt.Sprintf("%s:%d:%d", p.filename, p.line, p.col)
+	}
 	return fmt.Sprintf("%d:%d", p.line, p.col)
 }
 
@@ -110,305 +128,719 @@ func (tok Tok) String() string {
 	}
 }
 
+// Err is a structured lexer error, carrying enough position information
+// to render a compiler-style diagnostic with FormatError, rather than
+// just a formatted message string.
+type Err struct {
+	Reason   int
+	Message  string
+	Filename string
+	Line     int
+	Col      int
+	EndCol   int
+	// Source is the offending source line as far as the scanner had
+	// read it when the error was reported: the rest of the line after
+	// that point is not included, and neither are runes consumed as part
+	// of an escape sequence, a comment or a two-character operator.
+	// FormatError uses the line from its src argument when src has it.
+	Source string
+}
+
+func (e Err) Error() string {
+	return e.Message
+}
+
+// ErrorHandler is called once per lex error encountered during
+// Tokenize, in the order they're found. Embedders -- the CLI, an LSP
+// integration, test harnesses -- can register one to collect every
+// error from a source rather than only seeing the first one logged to
+// stderr.
+type ErrorHandler func(Err)
+
+// FormatError renders err as a human-readable diagnostic: the error
+// message followed by the offending source line and a caret (^~~~)
+// spanning err.Col..err.EndCol.
+func FormatError(err Err, src []byte) string {
+	srcLine := err.Source
+	if lines := strings.Split(string(src), "\n"); err.Line-1 >= 0 && err.Line-1 < len(lines) {
+		srcLine = lines[err.Line-1]
+	}
+
+	loc := fmt.Sprintf("%d:%d", err.Line, err.Col)
+	if err.Filename != "" {
+		loc = err.Filename + ":" + loc
+	}
+
+	col := err.Col
+	if col < 1 {
+		col = 1
+	}
+
+	width := err.EndCol - err.Col
+	if width < 1 {
+		width = 1
+	}
+	caret := strings.Repeat(" ", col-1) + "^" + strings.Repeat("~", width-1)
+
+	return fmt.Sprintf("%s: %s\n\t%s\n\t%s", loc, err.Message, srcLine, caret)
+}
+
 // Tokenize takes an io.Reader and transforms it into a stream of Tok (tokens).
+//
+// It's a thin, backwards-compatible wrapper around Scanner for callers
+// that want a channel of tokens rather than pulling them one at a time.
+// If errh is non-nil, it's called once per lex error found, with a
+// structured Err describing the problem; otherwise lex errors fall back
+// to being logged directly via LogErr / LogSafeErr, as before.
 func Tokenize(
 	unbuffered io.Reader,
 	tokens chan<- Tok,
 	fatalError bool,
 	debugLexer bool,
+	errh ErrorHandler,
 ) {
-	defer close(tokens)
+	tokenize(unbuffered, "", tokens, fatalError, debugLexer, errh)
+}
+
+// TokenizeFile opens the file at path and tokenizes its contents,
+// threading path through every Tok's position as its Filename. This is
+// a prerequisite for building source maps, jump-to-definition, and
+// error messages that span multiple files (e.g. a future `load`
+// primitive).
+func TokenizeFile(
+	path string,
+	tokens chan<- Tok,
+	fatalError bool,
+	debugLexer bool,
+	errh ErrorHandler,
+) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	var buf, strbuf string
-	var strbufStartLine, strbufStartCol int
+	tokenize(f, path, tokens, fatalError, debugLexer, errh)
+	return nil
+}
+
+func tokenize(
+	unbuffered io.Reader,
+	filename string,
+	tokens chan<- Tok,
+	fatalError bool,
+	debugLexer bool,
+	errh ErrorHandler,
+) {
+	defer close(tokens)
 
-	lastKind := Separator
-	lineNo, colNo := 1, 1
+	var s Scanner
+	s.Init(unbuffered, filename, errh, 0)
+	s.fatalError = fatalError
+	s.debugLexer = debugLexer
 
-	simpleCommit := func(tok Tok) {
-		lastKind = tok.kind
-		if debugLexer {
-			LogDebug("lex ->", tok.String())
+	for {
+		tok := s.Scan()
+		if tok.kind == EOF {
+			return
 		}
 		tokens <- tok
 	}
-	simpleCommitChar := func(kind Kind) {
-		simpleCommit(Tok{
-			kind:     kind,
-			position: position{lineNo, colNo},
-		})
+}
+
+// Mode is a bitset of options controlling how a Scanner tokenizes its
+// input.
+type Mode uint
+
+const (
+	// ScanComments causes comments to be emitted as Comment tokens
+	// instead of being discarded, for tools like formatters that need
+	// to preserve trivia.
+	ScanComments Mode = 1 << iota
+	// DontInsertSeparators disables the automatic Separator insertion
+	// normally performed at newlines and before closing brackets, for
+	// tools that need the token stream to mirror the source exactly.
+	DontInsertSeparators
+)
+
+// defaultKeywords is the keyword table Init gives every Scanner.
+// Embedders that want to add domain-specific keywords (if, with,
+// import, ...) can copy this table into their own and register it on
+// the Scanner with SetKeywords.
+var defaultKeywords = map[string]Kind{
+	"true":  TrueLiteral,
+	"false": FalseLiteral,
+}
+
+// Scanner turns a stream of bytes into Ink tokens, one at a time, via
+// Scan. It's the pull-based counterpart to the channel-based Tokenize:
+// callers that want to interleave lexing with parsing (or stop early)
+// can call Scan synchronously instead of ranging over a channel fed by
+// a separate goroutine.
+type Scanner struct {
+	file     string
+	errh     ErrorHandler
+	mode     Mode
+	keywords map[string]Kind
+
+	// fatalError and debugLexer preserve Tokenize's historical
+	// behavior for callers that don't register an ErrorHandler.
+	fatalError bool
+	debugLexer bool
+
+	buffered *bufio.Reader
+
+	buf, strbuf                                        string
+	strbufStartLine, strbufStartCol, strbufStartOffset int
+	curLine                                            []rune
+	// bufIsNumeric tracks whether buf is being accumulated as a number
+	// literal (started with a digit), so that '.', '_', and the
+	// exponent sign can be told apart from AccessorOp, EmptyIdentifier,
+	// and SubtractOp/AddOp respectively.
+	bufIsNumeric bool
+
+	lastKind        Kind
+	lineNo, colNo   int
+	offset          int
+	inStringLiteral bool
+	atEOF           bool
+
+	// queued holds tokens produced but not yet returned by Scan: some
+	// scanning steps (e.g. flushing buf before a delimiter) produce
+	// two tokens at once.
+	queued []Tok
+}
+
+// Init prepares s to scan src from scratch, discarding any previous
+// state. file is threaded through every Tok's position as its
+// Filename; pass "" if src isn't a named file. If errh is non-nil, it's
+// called once per lex error found. mode is a bitset of Scanner options;
+// see ScanComments and DontInsertSeparators.
+func (s *Scanner) Init(src io.Reader, file string, errh ErrorHandler, mode Mode) {
+	*s = Scanner{
+		file:     file,
+		errh:     errh,
+		mode:     mode,
+		keywords: defaultKeywords,
+		buffered: bufio.NewReader(src),
+		lastKind: Separator,
+		lineNo:   1,
+		colNo:    1,
 	}
-	commitClear := func() {
-		if buf == "" {
-			// no need to commit empty token
-			return
+
+	peeked, err := s.buffered.Peek(2)
+	if err == nil && string(peeked) == "#!" {
+		// shebang-style ignored line, keep taking until EOL
+		var nextChar rune
+		for nextChar != '\n' {
+			nextChar, _, err = s.buffered.ReadRune()
+			if err != nil {
+				break
+			}
+			s.offset += len(string(nextChar))
 		}
 
-		cbuf := buf
-		buf = ""
-		switch cbuf {
-		case "true":
-			simpleCommitChar(TrueLiteral)
-		case "false":
-			simpleCommitChar(FalseLiteral)
-		default:
-			if unicode.IsDigit(rune(cbuf[0])) {
-				f, err := strconv.ParseFloat(cbuf, 64)
-				if err != nil {
-					e := Err{
-						ErrSyntax,
-						fmt.Sprintf("parsing error in number at %d:%d, %s",
-							lineNo, colNo, err.Error()),
-					}
-					if fatalError {
-						LogErr(e.reason, e.message)
-					} else {
-						LogSafeErr(e.reason, e.message)
-					}
-				}
-				simpleCommit(Tok{
-					num:      f,
-					kind:     NumberLiteral,
-					position: position{lineNo, colNo - len(cbuf)},
-				})
-			} else {
-				simpleCommit(Tok{
-					str:      cbuf,
-					kind:     Identifier,
-					position: position{lineNo, colNo - len(cbuf)},
-				})
+		s.lineNo++
+	}
+}
+
+// SetKeywords replaces s's keyword table, so embedders can register
+// domain-specific keywords without editing the scanner core.
+func (s *Scanner) SetKeywords(keywords map[string]Kind) {
+	s.keywords = keywords
+}
+
+// Scan reads and returns the next token from the source. Once the
+// source is exhausted, it returns a Tok of kind EOF on every subsequent
+// call.
+func (s *Scanner) Scan() Tok {
+	if s.atEOF && len(s.queued) == 0 {
+		return Tok{kind: EOF, position: s.pos(s.lineNo, s.colNo, s.offset)}
+	}
+
+	for len(s.queued) == 0 {
+		if !s.step() {
+			if s.inStringLiteral {
+				s.reportErr(s.strbufStartLine, s.strbufStartCol, s.colNo, "unterminated string literal")
+				s.inStringLiteral = false
+			}
+			s.ensureSeparator()
+			s.atEOF = true
+			if len(s.queued) == 0 {
+				s.emitChar(EOF)
 			}
+			break
 		}
 	}
-	commit := func(tok Tok) {
-		commitClear()
-		simpleCommit(tok)
+
+	tok := s.queued[0]
+	s.queued = s.queued[1:]
+	return tok
+}
+
+func (s *Scanner) pos(line, col, off int) position {
+	return position{s.file, line, col, off}
+}
+
+func (s *Scanner) reportErr(line, col, endCol int, message string) {
+	e := Err{
+		Reason:   ErrSyntax,
+		Message:  message,
+		Filename: s.file,
+		Line:     line,
+		Col:      col,
+		EndCol:   endCol,
+		Source:   string(s.curLine),
+	}
+	if s.errh != nil {
+		s.errh(e)
+	} else if s.fatalError {
+		LogErr(e.Reason, e.Message)
+	} else {
+		LogSafeErr(e.Reason, e.Message)
 	}
-	commitChar := func(kind Kind) {
-		commit(Tok{
-			kind:     kind,
-			position: position{lineNo, colNo},
-		})
+}
+
+func (s *Scanner) emit(tok Tok) {
+	s.lastKind = tok.kind
+	if s.debugLexer {
+		LogDebug("lex ->", tok.String())
 	}
-	ensureSeparator := func() {
-		commitClear()
-		switch lastKind {
-		case Separator, LeftParen, LeftBracket, LeftBrace,
-			AddOp, SubtractOp, MultiplyOp, DivideOp, ModulusOp, NegationOp,
-			GreaterThanOp, LessThanOp, EqualOp, DefineOp, AccessorOp,
-			KeyValueSeparator, FunctionArrow, MatchColon, CaseArrow:
-			// do nothing
-		default:
-			commitChar(Separator)
-		}
+	s.queued = append(s.queued, tok)
+}
+
+func (s *Scanner) emitChar(kind Kind) {
+	s.emit(Tok{
+		kind:     kind,
+		position: s.pos(s.lineNo, s.colNo, s.offset),
+	})
+}
+
+func (s *Scanner) flushBuf() {
+	if s.buf == "" {
+		// no need to emit empty token
+		return
 	}
 
-	inStringLiteral := false
-	buffered := bufio.NewReader(unbuffered)
+	cbuf := s.buf
+	s.buf = ""
+	s.bufIsNumeric = false
 
-	peeked, err := buffered.Peek(2)
-	if string(peeked) == "#!" {
-		// shebang-style ignored line, keep taking until EOL
-		var nextChar rune
-		for nextChar != '\n' {
-			nextChar, _, err = buffered.ReadRune()
-			if err != nil {
-				break
-			}
+	if kind, isKeyword := s.keywords[cbuf]; isKeyword {
+		s.emitChar(kind)
+		return
+	}
+
+	if unicode.IsDigit(rune(cbuf[0])) {
+		f, err := parseNumberLiteral(cbuf)
+		if err != nil {
+			s.reportErr(s.lineNo, s.colNo-len(cbuf), s.colNo,
+				fmt.Sprintf("malformed number literal '%s': %s", cbuf, err.Error()))
 		}
+		s.emit(Tok{
+			num:      f,
+			kind:     NumberLiteral,
+			position: s.pos(s.lineNo, s.colNo-len(cbuf), s.offset-len(cbuf)),
+		})
+	} else {
+		s.emit(Tok{
+			str:      cbuf,
+			kind:     Identifier,
+			position: s.pos(s.lineNo, s.colNo-len(cbuf), s.offset-len(cbuf)),
+		})
+	}
+}
 
-		lineNo++
+func (s *Scanner) commit(tok Tok) {
+	s.flushBuf()
+	s.emit(tok)
+}
+
+func (s *Scanner) commitChar(kind Kind) {
+	s.commit(Tok{
+		kind:     kind,
+		position: s.pos(s.lineNo, s.colNo, s.offset),
+	})
+}
+
+func (s *Scanner) ensureSeparator() {
+	s.flushBuf()
+	if s.mode&DontInsertSeparators != 0 {
+		return
+	}
+	switch s.lastKind {
+	case Separator, LeftParen, LeftBracket, LeftBrace,
+		AddOp, SubtractOp, MultiplyOp, DivideOp, ModulusOp, NegationOp,
+		GreaterThanOp, LessThanOp, EqualOp, DefineOp, AccessorOp,
+		KeyValueSeparator, FunctionArrow, MatchColon, CaseArrow:
+		// do nothing
+	default:
+		s.commitChar(Separator)
 	}
+}
 
-	for {
-		char, _, err := buffered.ReadRune()
+// readHexEscape reads n hex digits for a \x, \u, or \U escape and
+// decodes them into a single rune. ok is true only if all n digits were
+// read and valid hex; otherwise invalidCol is the column of the first
+// invalid digit encountered, or 0 if the input ended before n digits
+// were read (a truncated escape, as opposed to a malformed one).
+func (s *Scanner) readHexEscape(n int) (val rune, ok bool, invalidCol int) {
+	for i := 0; i < n; i++ {
+		h, _, err := s.buffered.ReadRune()
 		if err != nil {
-			break
+			return 0, false, 0
 		}
+		s.colNo++
+		s.offset += len(string(h))
 
-		switch {
-		case char == '\'':
-			if inStringLiteral {
-				commit(Tok{
-					str:      strbuf,
-					kind:     StringLiteral,
-					position: position{strbufStartLine, strbufStartCol},
-				})
-			} else {
-				strbuf = ""
-				strbufStartLine, strbufStartCol = lineNo, colNo
-			}
-			inStringLiteral = !inStringLiteral
-		case inStringLiteral:
-			if char == '\n' {
-				lineNo++
-				colNo = 0
-				strbuf += string(char)
-			} else if char == '\\' {
-				// backslash escapes like in most other languages,
-				// so just consume whatever the next char is into
-				// the current string buffer
-				c, _, err := buffered.ReadRune()
-				if err != nil {
-					break
-				}
-				strbuf += string(c)
-				colNo++
-			} else {
-				strbuf += string(char)
-			}
-		case char == '`':
-			nextChar, _, err := buffered.ReadRune()
+		d, err := strconv.ParseInt(string(h), 16, 32)
+		if err != nil {
+			return 0, false, s.colNo
+		}
+		val = val<<4 | rune(d)
+	}
+	return val, true, 0
+}
+
+// step consumes one source rune and advances scanner state accordingly,
+// queuing zero or more tokens via s.emit. It returns false once the
+// underlying reader is exhausted.
+func (s *Scanner) step() bool {
+	char, _, err := s.buffered.ReadRune()
+	if err != nil {
+		return false
+	}
+
+	if char == '\n' {
+		s.curLine = s.curLine[:0]
+	} else {
+		s.curLine = append(s.curLine, char)
+	}
+
+	switch {
+	case char == '\'':
+		if s.inStringLiteral {
+			s.commit(Tok{
+				str:      s.strbuf,
+				kind:     StringLiteral,
+				position: s.pos(s.strbufStartLine, s.strbufStartCol, s.strbufStartOffset),
+			})
+		} else {
+			s.strbuf = ""
+			s.strbufStartLine, s.strbufStartCol, s.strbufStartOffset = s.lineNo, s.colNo, s.offset
+		}
+		s.inStringLiteral = !s.inStringLiteral
+	case s.inStringLiteral:
+		if char == '\n' {
+			s.lineNo++
+			s.colNo = 0
+			s.strbuf += string(char)
+		} else if char == '\\' {
+			escCol := s.colNo + 1
+			c, _, err := s.buffered.ReadRune()
 			if err != nil {
+				s.reportErr(s.lineNo, escCol, escCol, "unterminated escape sequence in string literal")
 				break
 			}
-
-			if nextChar == '`' {
-				// single-line comment, keep taking until EOL
-				for nextChar != '\n' {
-					nextChar, _, err = buffered.ReadRune()
-					if err != nil {
-						break
-					}
+			s.colNo++
+			s.offset += len(string(c))
+
+			switch c {
+			case 'n':
+				s.strbuf += "\n"
+			case 'r':
+				s.strbuf += "\r"
+			case 't':
+				s.strbuf += "\t"
+			case '\\':
+				s.strbuf += "\\"
+			case '\'':
+				s.strbuf += "'"
+			case '0':
+				s.strbuf += "\x00"
+			case 'x':
+				if v, ok, badCol := s.readHexEscape(2); ok {
+					s.strbuf += string([]byte{byte(v)})
+				} else if badCol != 0 {
+					s.reportErr(s.lineNo, badCol, badCol+1, "invalid hex digit in \\x escape")
+				} else {
+					s.reportErr(s.lineNo, escCol, s.colNo+1, "truncated \\x escape sequence")
 				}
-
-				ensureSeparator()
-				lineNo++
-				colNo = 0
-			} else {
-				// multi-line block comment, keep taking until end of block
-				for nextChar != '`' {
-					nextChar, _, err = buffered.ReadRune()
-					if err != nil {
-						break
+			case 'u':
+				if v, ok, badCol := s.readHexEscape(4); ok {
+					if v < 0 || v > unicode.MaxRune || (0xD800 <= v && v <= 0xDFFF) {
+						s.reportErr(s.lineNo, escCol, s.colNo+1, "invalid unicode code point in \\u escape")
+					} else {
+						s.strbuf += string(v)
 					}
-
-					if nextChar == '\n' {
-						lineNo++
-						colNo = 0
+				} else if badCol != 0 {
+					s.reportErr(s.lineNo, badCol, badCol+1, "invalid hex digit in \\u escape")
+				} else {
+					s.reportErr(s.lineNo, escCol, s.colNo+1, "truncated \\u escape sequence")
+				}
+			case 'U':
+				if v, ok, badCol := s.readHexEscape(8); ok {
+					if v < 0 || v > unicode.MaxRune || (0xD800 <= v && v <= 0xDFFF) {
+						s.reportErr(s.lineNo, escCol, s.colNo+1, "invalid unicode code point in \\U escape")
+					} else {
+						s.strbuf += string(v)
 					}
-					colNo++
+				} else if badCol != 0 {
+					s.reportErr(s.lineNo, badCol, badCol+1, "invalid hex digit in \\U escape")
+				} else {
+					s.reportErr(s.lineNo, escCol, s.colNo+1, "truncated \\U escape sequence")
 				}
+			default:
+				s.reportErr(s.lineNo, escCol, escCol+1,
+					fmt.Sprintf("unknown escape sequence '\\%c'", c))
+				s.strbuf += string(c)
 			}
-		case char == '\n':
-			ensureSeparator()
-			lineNo++
-			colNo = 0
-		case unicode.IsSpace(char):
-			commitClear()
-		case char == '_':
-			commitChar(EmptyIdentifier)
-		case char == '~':
-			commitChar(NegationOp)
-		case char == '+':
-			commitChar(AddOp)
-		case char == '*':
-			commitChar(MultiplyOp)
-		case char == '/':
-			commitChar(DivideOp)
-		case char == '%':
-			commitChar(ModulusOp)
-		case char == '&':
-			commitChar(LogicalAndOp)
-		case char == '|':
-			commitChar(LogicalOrOp)
-		case char == '^':
-			commitChar(LogicalXorOp)
-		case char == '<':
-			commitChar(LessThanOp)
-		case char == '>':
-			commitChar(GreaterThanOp)
-		case char == ',':
-			commitChar(Separator)
-		case char == '.':
-			// only non-AccessorOp case is [Number token] . [Number],
-			// so we commit and bail early if the buf is empty or contains
-			// a clearly non-numeric token. Note that this means all numbers
-			// must start with a digit. i.e. .5 is not 0.5 but a syntax error.
-			// This is the case since we don't know what the last token was,
-			// and I think streaming parse is worth the tradeoffs of losing
-			// that context.
-			committed := false
-			for _, d := range buf {
-				if !unicode.IsDigit(d) {
-					commitChar(AccessorOp)
-					committed = true
+		} else {
+			s.strbuf += string(char)
+		}
+	case char == '`':
+		nextChar, _, err := s.buffered.ReadRune()
+		if err != nil {
+			break
+		}
+		s.colNo++
+		s.offset += len(string(nextChar))
+
+		var comment strings.Builder
+		comment.WriteRune(char)
+		comment.WriteRune(nextChar)
+
+		if nextChar == '`' {
+			// single-line comment, keep taking until EOL
+			for nextChar != '\n' {
+				nextChar, _, err = s.buffered.ReadRune()
+				if err != nil {
 					break
 				}
+				comment.WriteRune(nextChar)
+				s.colNo++
+				s.offset += len(string(nextChar))
 			}
-			if !committed {
-				if buf == "" {
-					commitChar(AccessorOp)
-				} else {
-					buf += "."
-				}
-			}
-		case char == ':':
-			nextChar, _, err := buffered.ReadRune()
-			if err != nil {
-				break
-			}
+			s.curLine = s.curLine[:0]
 
-			colNo++
-			if nextChar == '=' {
-				commitChar(DefineOp)
-			} else if nextChar == ':' {
-				commitChar(MatchColon)
-			} else {
-				// key is parsed as expression, so make sure
-				// we mark expression end (Separator)
-				ensureSeparator()
-				commitChar(KeyValueSeparator)
-				buffered.UnreadRune()
-			}
-		case char == '=':
-			nextChar, _, err := buffered.ReadRune()
-			if err != nil {
-				break
+			if s.mode&ScanComments != 0 {
+				s.commit(Tok{
+					str:      comment.String(),
+					kind:     Comment,
+					position: s.pos(s.lineNo, s.colNo, s.offset),
+				})
 			}
 
-			colNo++
-			if nextChar == '>' {
-				commitChar(FunctionArrow)
-			} else {
-				commitChar(EqualOp)
-				buffered.UnreadRune()
+			s.ensureSeparator()
+			s.lineNo++
+			s.colNo = 0
+		} else {
+			// multi-line block comment, keep taking until end of block
+			closed := false
+			for nextChar != '`' {
+				nextChar, _, err = s.buffered.ReadRune()
+				if err != nil {
+					break
+				}
+				closed = nextChar == '`'
+				comment.WriteRune(nextChar)
+
+				if nextChar == '\n' {
+					s.lineNo++
+					s.colNo = 0
+					s.curLine = s.curLine[:0]
+				}
+				s.colNo++
+				s.offset += len(string(nextChar))
 			}
-		case char == '-':
-			nextChar, _, err := buffered.ReadRune()
-			if err != nil {
-				break
+			if !closed {
+				s.reportErr(s.lineNo, s.colNo, s.colNo, "unterminated block comment")
+			} else if s.mode&ScanComments != 0 {
+				s.commit(Tok{
+					str:      comment.String(),
+					kind:     Comment,
+					position: s.pos(s.lineNo, s.colNo, s.offset),
+				})
 			}
+		}
+	case char == '\n':
+		s.ensureSeparator()
+		s.lineNo++
+		s.colNo = 0
+	case unicode.IsSpace(char):
+		s.flushBuf()
+	case char == '_' && s.bufIsNumeric:
+		// digit-group separator, e.g. 1_000_000
+		s.buf += string(char)
+	case char == '_':
+		s.commitChar(EmptyIdentifier)
+	case char == '~':
+		s.commitChar(NegationOp)
+	case char == '+' && s.bufIsNumeric && endsWithExponentMarker(s.buf):
+		// sign of a scientific-notation exponent, e.g. the '+' in 1.5e+3
+		s.buf += string(char)
+	case char == '+':
+		s.commitChar(AddOp)
+	case char == '*':
+		s.commitChar(MultiplyOp)
+	case char == '/':
+		s.commitChar(DivideOp)
+	case char == '%':
+		s.commitChar(ModulusOp)
+	case char == '&':
+		s.commitChar(LogicalAndOp)
+	case char == '|':
+		s.commitChar(LogicalOrOp)
+	case char == '^':
+		s.commitChar(LogicalXorOp)
+	case char == '<':
+		s.commitChar(LessThanOp)
+	case char == '>':
+		s.commitChar(GreaterThanOp)
+	case char == ',':
+		s.commitChar(Separator)
+	case char == '.':
+		// only non-AccessorOp case is [Number token] . [Number],
+		// so we commit and bail early unless buf is currently being
+		// lexed as a number. Note that this means all numbers must
+		// start with a digit. i.e. .5 is not 0.5 but a syntax error.
+		// This is the case since we don't know what the last token
+		// was, and I think streaming parse is worth the tradeoffs
+		// of losing that context.
+		if s.bufIsNumeric {
+			s.buf += "."
+		} else {
+			s.commitChar(AccessorOp)
+		}
+	case char == ':':
+		nextChar, _, err := s.buffered.ReadRune()
+		if err != nil {
+			break
+		}
 
-			colNo++
-			if nextChar == '>' {
-				commitChar(CaseArrow)
-			} else {
-				commitChar(SubtractOp)
-				buffered.UnreadRune()
-			}
-		case char == '(':
-			commitChar(LeftParen)
-		case char == ')':
-			ensureSeparator()
-			commitChar(RightParen)
-		case char == '[':
-			commitChar(LeftBracket)
-		case char == ']':
-			ensureSeparator()
-			commitChar(RightBracket)
-		case char == '{':
-			commitChar(LeftBrace)
-		case char == '}':
-			ensureSeparator()
-			commitChar(RightBrace)
-		default:
-			buf += string(char)
+		if nextChar == '=' {
+			s.colNo++
+			s.offset += len(string(nextChar))
+			s.commitChar(DefineOp)
+		} else if nextChar == ':' {
+			s.colNo++
+			s.offset += len(string(nextChar))
+			s.commitChar(MatchColon)
+		} else {
+			// key is parsed as expression, so make sure
+			// we mark expression end (Separator)
+			s.ensureSeparator()
+			s.commitChar(KeyValueSeparator)
+			s.buffered.UnreadRune()
 		}
-		colNo++
+	case char == '=':
+		nextChar, _, err := s.buffered.ReadRune()
+		if err != nil {
+			break
+		}
+
+		if nextChar == '>' {
+			s.colNo++
+			s.offset += len(string(nextChar))
+			s.commitChar(FunctionArrow)
+		} else {
+			s.commitChar(EqualOp)
+			s.buffered.UnreadRune()
+		}
+	case char == '-' && s.bufIsNumeric && endsWithExponentMarker(s.buf):
+		// sign of a scientific-notation exponent, e.g. the '-' in 1.5e-3
+		s.buf += string(char)
+	case char == '-':
+		nextChar, _, err := s.buffered.ReadRune()
+		if err != nil {
+			break
+		}
+
+		if nextChar == '>' {
+			s.colNo++
+			s.offset += len(string(nextChar))
+			s.commitChar(CaseArrow)
+		} else {
+			s.commitChar(SubtractOp)
+			s.buffered.UnreadRune()
+		}
+	case char == '(':
+		s.commitChar(LeftParen)
+	case char == ')':
+		s.ensureSeparator()
+		s.commitChar(RightParen)
+	case char == '[':
+		s.commitChar(LeftBracket)
+	case char == ']':
+		s.ensureSeparator()
+		s.commitChar(RightBracket)
+	case char == '{':
+		s.commitChar(LeftBrace)
+	case char == '}':
+		s.ensureSeparator()
+		s.commitChar(RightBrace)
+	default:
+		if s.buf == "" && unicode.IsDigit(char) {
+			s.bufIsNumeric = true
+		}
+		s.buf += string(char)
 	}
+	s.colNo++
+	s.offset += len(string(char))
+	return true
+}
 
-	ensureSeparator()
+// endsWithExponentMarker reports whether buf, a number literal being
+// accumulated so far, ends in a scientific-notation exponent marker
+// ('e' or 'E') that a following '+' or '-' should be read as the sign
+// of, rather than as AddOp/SubtractOp. Hex literals are excluded, since
+// 'E' is also a valid hex digit (0xFE is a complete literal, not one
+// with a dangling exponent) -- the same ambiguity Go's own literal
+// grammar sidesteps by reserving 'e' for decimal/'p' for hex floats.
+func endsWithExponentMarker(buf string) bool {
+	if len(buf) == 0 {
+		return false
+	}
+	if strings.HasPrefix(buf, "0x") || strings.HasPrefix(buf, "0X") {
+		return false
+	}
+	last := buf[len(buf)-1]
+	return last == 'e' || last == 'E'
+}
+
+// parseNumberLiteral parses a number literal buffer into a float64.
+// Besides plain decimal integers and floats, it accepts 0x/0o/0b
+// prefixes, digit-group separators ('_'), and scientific notation
+// (1.5e-3, 2E10). Underscores are validated and stripped before
+// delegating to strconv.
+func parseNumberLiteral(cbuf string) (float64, error) {
+	if strings.Contains(cbuf, "__") || strings.HasPrefix(cbuf, "_") || strings.HasSuffix(cbuf, "_") {
+		return 0, fmt.Errorf("invalid use of '_' digit separator")
+	}
+	clean := strings.ReplaceAll(cbuf, "_", "")
+
+	switch {
+	case strings.HasPrefix(clean, "0x"), strings.HasPrefix(clean, "0X"):
+		n, err := strconv.ParseInt(clean[2:], 16, 64)
+		if err != nil {
+			return 0, err
+		}
+		return float64(n), nil
+	case strings.HasPrefix(clean, "0o"), strings.HasPrefix(clean, "0O"):
+		n, err := strconv.ParseInt(clean[2:], 8, 64)
+		if err != nil {
+			return 0, err
+		}
+		return float64(n), nil
+	case strings.HasPrefix(clean, "0b"), strings.HasPrefix(clean, "0B"):
+		n, err := strconv.ParseInt(clean[2:], 2, 64)
+		if err != nil {
+			return 0, err
+		}
+		return float64(n), nil
+	default:
+		return strconv.ParseFloat(clean, 64)
+	}
 }
 
 func (kind Kind) String() string {
@@ -441,6 +873,9 @@ func (kind Kind) String() string {
 	case FunctionLiteral:
 		return "function literal"
 
+	case Comment:
+		return "comment"
+
 	case TrueLiteral:
 		return "'true'"
 	case FalseLiteral:
@@ -503,6 +938,9 @@ func (kind Kind) String() string {
 	case RightBrace:
 		return "'}'"
 
+	case EOF:
+		return "end of file"
+
 	default:
 		return "unknown token"
 	}